@@ -7,8 +7,11 @@ import (
 	"io/fs"
 	"net"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
 	"github.com/AdguardTeam/golibs/errors"
@@ -34,15 +37,43 @@ type requestMatcher struct {
 	// stateLock protects all the fields of requestMatcher.
 	stateLock *sync.RWMutex
 
-	// rulesStrg stores the rules obtained from the hosts' file.
+	// rulesStrg stores the exact, i.e. main/alias and negated, rules
+	// obtained from the hosts' file.
 	rulesStrg *filterlist.RuleStorage
 	// engine serves rulesStrg.
 	engine *urlfilter.DNSEngine
 
-	// translator maps generated $dnsrewrite rules into hosts-syntax rules.
-	//
-	// TODO(e.burkov):  Store the filename from which the rule was parsed.
-	translator map[string]string
+	// wildcardStrg stores the wildcard domain rules obtained from the
+	// hosts' file, kept separate from rulesStrg so that an exact rule
+	// always takes precedence over a wildcard one, see MatchRequest.
+	wildcardStrg *filterlist.RuleStorage
+	// wildcardEngine serves wildcardStrg.
+	wildcardEngine *urlfilter.DNSEngine
+
+	// translator maps generated $dnsrewrite rules into hosts-syntax rules
+	// along with the file each rule was parsed from.
+	translator map[string]translation
+
+	// entries is the read-only view of the merged hosts table as of the
+	// last change, see Snapshot.
+	entries []HostEntry
+}
+
+// translation is the hosts-syntax counterpart of a generated $dnsrewrite
+// rule, along with the path to the file it originates from.
+type translation struct {
+	// line is the hosts-syntax line equivalent of the generated rule.
+	line string
+
+	// sourceFile is the path, relative to the container's fs.FS, to the file
+	// the rule was parsed from.
+	sourceFile string
+
+	// ttl is the TTL parsed from the line's "# ttl=N" comment, or zero if it
+	// had none.  The dnsrewrite rule syntax has no TTL modifier of its own,
+	// so this isn't baked into the generated rule; it's surfaced here for
+	// the caller to apply when constructing the actual DNS response.
+	ttl uint32
 }
 
 // MatchRequest processes the request rewriting hostnames and addresses read
@@ -54,6 +85,10 @@ type requestMatcher struct {
 // be direct, i.e. any returned CNAME resolves into actual address like an alias
 // in hosts does, see man hosts (5).
 //
+// Exact hosts always take precedence over a wildcard domain covering the
+// same name: the wildcard engine is only consulted once the exact one has
+// no match for req.
+//
 // It's safe for concurrent use.
 func (rm *requestMatcher) MatchRequest(
 	req urlfilter.DNSRequest,
@@ -68,37 +103,135 @@ func (rm *requestMatcher) MatchRequest(
 	rm.stateLock.RLock()
 	defer rm.stateLock.RUnlock()
 
-	return rm.engine.MatchRequest(req)
+	if res, ok = rm.engine.MatchRequest(req); ok {
+		return res, ok
+	}
+
+	return rm.wildcardEngine.MatchRequest(req)
 }
 
-// Translate returns the source hosts-syntax rule for the generated dnsrewrite
-// rule or an empty string if the last doesn't exist.  The returned rules are in
-// a processed format like:
+// Translate returns the source hosts-syntax rule, the path to the file it
+// was parsed from, and its TTL for the generated dnsrewrite rule.  ok is
+// false if rule is unknown.  ttl is zero if the line had no "# ttl=N"
+// comment; since dnsrewrite rules have no TTL modifier of their own, it's up
+// to the caller to apply ttl when constructing the actual DNS response.  The
+// returned rules are in a processed format like:
 //
 //   ip host1 host2 ...
 //
-func (rm *requestMatcher) Translate(rule string) (hostRule string) {
+func (rm *requestMatcher) Translate(rule string) (hostRule, sourceFile string, ttl uint32, ok bool) {
 	rm.stateLock.RLock()
 	defer rm.stateLock.RUnlock()
 
-	return rm.translator[rule]
+	tr, ok := rm.translator[rule]
+
+	return tr.line, tr.sourceFile, tr.ttl, ok
 }
 
-// resetEng updates container's engine and the translation map.
-func (rm *requestMatcher) resetEng(rulesStrg *filterlist.RuleStorage, tr map[string]string) {
+// Snapshot returns a copy of the current merged hosts table, one entry per IP
+// address with its main hostname, for read-only display, e.g. in the UI.  A
+// hostname that is the main one for several addresses appears once for each.
+//
+// It's safe for concurrent use.
+func (rm *requestMatcher) Snapshot() (entries []HostEntry) {
+	rm.stateLock.RLock()
+	defer rm.stateLock.RUnlock()
+
+	return append([]HostEntry(nil), rm.entries...)
+}
+
+// resetEng updates container's engines, translation map, and snapshot
+// entries.
+func (rm *requestMatcher) resetEng(
+	rulesStrg *filterlist.RuleStorage,
+	wildcardStrg *filterlist.RuleStorage,
+	tr map[string]translation,
+	entries []HostEntry,
+) {
 	rm.stateLock.Lock()
 	defer rm.stateLock.Unlock()
 
 	rm.rulesStrg = rulesStrg
 	rm.engine = urlfilter.NewDNSEngine(rm.rulesStrg)
 
+	rm.wildcardStrg = wildcardStrg
+	rm.wildcardEngine = urlfilter.NewDNSEngine(rm.wildcardStrg)
+
 	rm.translator = tr
+	rm.entries = entries
 }
 
 // hostsContainerPref is a prefix for logging and wrapping errors in
 // HostsContainer's methods.
 const hostsContainerPref = "hosts container"
 
+// HostEntry is a single main hostname's contribution to the merged hosts
+// table, as reported by Snapshot.
+type HostEntry struct {
+	// IP is the address the entry is for.
+	IP net.IP
+
+	// Main is the primary hostname mapped to IP.
+	Main string
+
+	// Aliases are the additional hostnames mapped to IP, if any.
+	Aliases []string
+
+	// SourceFile is the path, relative to the container's fs.FS, to the
+	// file Main was parsed from.
+	SourceFile string
+
+	// LineNo is the 1-based number of the line Main was parsed from within
+	// SourceFile.
+	LineNo int
+}
+
+// HostsContainerMetrics is a snapshot of the counters and timings collected
+// by a HostsContainer across its refreshes, returned by Metrics.  It's a
+// plain, marshalable struct rather than a registerable prometheus.Collector,
+// since this package doesn't otherwise depend on the prometheus client; a
+// caller that does may convert it into its own collector or expose it
+// directly over the HTTP API.
+type HostsContainerMetrics struct {
+	// RefreshesTotal is the number of completed refreshes, successful or
+	// not.
+	RefreshesTotal uint64
+
+	// RefreshErrorsTotal is the number of refreshes that returned an error.
+	RefreshErrorsTotal uint64
+
+	// ParseErrorsTotal is the number of files that failed to be read or
+	// scanned during a refresh.
+	ParseErrorsTotal uint64
+
+	// RulesA is the number of A rules generated by the last refresh that
+	// produced a change.
+	RulesA uint64
+
+	// RulesAAAA is the number of AAAA rules generated by the last refresh
+	// that produced a change.
+	RulesAAAA uint64
+
+	// RulesPTR is the number of PTR rules generated by the last refresh
+	// that produced a change.
+	RulesPTR uint64
+
+	// RulesCNAME is the number of CNAME, i.e. alias, rules generated by the
+	// last refresh that produced a change.
+	RulesCNAME uint64
+
+	// DuplicatesTotal is the cumulative number of ip-host and alias pairs
+	// skipped as duplicates.
+	DuplicatesTotal uint64
+
+	// LastRefreshDuration is the duration of the last refresh.
+	LastRefreshDuration time.Duration
+
+	// RefreshDurationTotal is the sum of the durations of every refresh.
+	// Divide by RefreshesTotal for the average.
+	RefreshDurationTotal time.Duration
+}
+
 // HostsContainer stores the relevant hosts database provided by the OS and
 // processes both A/AAAA and PTR DNS requests for those.
 type HostsContainer struct {
@@ -117,6 +250,37 @@ type HostsContainer struct {
 	// last is the set of hosts that was cached within last detected change.
 	last *netutil.IPMap
 
+	// lastRules is the generated rules list content cached within the last
+	// detected change.  It's compared in addition to last since wildcard and
+	// negated entries aren't reflected by the hosts table.
+	lastRules string
+
+	// fileCache stores the parsed lines of every matched file, keyed by its
+	// path, so that refresh only has to re-read the files named by its
+	// changed argument instead of the whole set, e.g. on every remote
+	// source re-download.
+	fileCache map[string][]hostsLine
+
+	// ext configures the hosts(5) syntax extensions recognized while
+	// parsing.
+	ext HostsExtensions
+
+	// ticker, if non-nil, makes handleEvents additionally refresh on an
+	// interval instead of solely reacting to fsnotify events.
+	ticker *time.Ticker
+
+	// onTick, if non-nil, is called right before a ticker-triggered
+	// refresh, e.g. to download remote sources into the backing fs.FS.  It
+	// returns the paths, if any, that should be forced to be re-read.
+	onTick func() (changed []string)
+
+	// metricsLock protects metrics.
+	metricsLock *sync.Mutex
+
+	// metrics holds the counters and timings collected across refreshes,
+	// see Metrics.
+	metrics HostsContainerMetrics
+
 	// fsys is the working file system to read hosts files from.
 	fsys fs.FS
 
@@ -135,26 +299,59 @@ type HostsContainer struct {
 const ErrNoHostsPaths errors.Error = "no valid paths to hosts files provided"
 
 // NewHostsContainer creates a container of hosts, that watches the paths with
-// w.  listID is used as an identifier of the underlying rules list.  paths
+// w.  listID is used as an identifier of the underlying rules list.  ext
+// enables hosts(5) syntax extensions beyond the standard grammar.  paths
 // shouldn't be empty and each of paths should locate either a file or a
 // directory in fsys.  fsys and w must be non-nil.
 func NewHostsContainer(
 	listID int,
 	fsys fs.FS,
 	w aghos.FSWatcher,
+	ext HostsExtensions,
+	paths ...string,
+) (hc *HostsContainer, err error) {
+	return newHostsContainer(listID, fsys, w, ext, 0, nil, nil, paths...)
+}
+
+// newHostsContainer is the implementation of NewHostsContainer that also
+// allows scheduling periodic refreshes.  A positive refreshInterval makes
+// handleEvents additionally refresh every refreshInterval, calling onTick,
+// if it's non-nil, right before doing so; this is used by
+// NewRemoteHostsContainer to poll its remote sources on a timer using the
+// same event loop that handles fsnotify events.  refreshInterval of zero
+// disables the ticker.
+//
+// alwaysPatterns, unlike the patterns derived from paths, are registered
+// regardless of whether a matching file currently exists; this is used by
+// NewRemoteHostsContainer to keep a remote source's name in hc.patterns even
+// if its initial download failed, so that a later successful re-download is
+// picked up by matchedFiles instead of being ignored forever.
+func newHostsContainer(
+	listID int,
+	fsys fs.FS,
+	w aghos.FSWatcher,
+	ext HostsExtensions,
+	refreshInterval time.Duration,
+	onTick func() (changed []string),
+	alwaysPatterns []string,
 	paths ...string,
 ) (hc *HostsContainer, err error) {
 	defer func() { err = errors.Annotate(err, "%s: %w", hostsContainerPref) }()
 
-	if len(paths) == 0 {
+	if len(paths) == 0 && len(alwaysPatterns) == 0 {
 		return nil, ErrNoHostsPaths
 	}
 
 	var patterns []string
-	patterns, err = pathsToPatterns(fsys, paths)
-	if err != nil {
-		return nil, err
-	} else if len(patterns) == 0 {
+	if len(paths) > 0 {
+		patterns, err = pathsToPatterns(fsys, paths)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	patterns = append(patterns, alwaysPatterns...)
+	if len(patterns) == 0 {
 		return nil, ErrNoHostsPaths
 	}
 
@@ -162,17 +359,26 @@ func NewHostsContainer(
 		requestMatcher: requestMatcher{
 			stateLock: &sync.RWMutex{},
 		},
-		listID:   listID,
-		done:     make(chan struct{}, 1),
-		updates:  make(chan *netutil.IPMap, 1),
-		fsys:     fsys,
-		w:        w,
-		patterns: patterns,
+		listID:      listID,
+		done:        make(chan struct{}, 1),
+		updates:     make(chan *netutil.IPMap, 1),
+		fileCache:   map[string][]hostsLine{},
+		ext:         ext,
+		onTick:      onTick,
+		metricsLock: &sync.Mutex{},
+		fsys:        fsys,
+		w:           w,
+		patterns:    patterns,
+	}
+
+	if refreshInterval > 0 {
+		hc.ticker = time.NewTicker(refreshInterval)
 	}
 
 	log.Debug("%s: starting", hostsContainerPref)
 
-	// Load initially.
+	// Load initially.  The file cache is empty so every matched file gets
+	// parsed.
 	if err = hc.refresh(); err != nil {
 		return nil, err
 	}
@@ -197,6 +403,10 @@ func NewHostsContainer(
 func (hc *HostsContainer) Close() (err error) {
 	log.Debug("%s: closing", hostsContainerPref)
 
+	if hc.ticker != nil {
+		hc.ticker.Stop()
+	}
+
 	close(hc.done)
 
 	return nil
@@ -208,6 +418,54 @@ func (hc *HostsContainer) Upd() (updates <-chan *netutil.IPMap) {
 	return hc.updates
 }
 
+// Metrics returns a snapshot of the counters and timings collected across
+// this container's refreshes.
+func (hc *HostsContainer) Metrics() (m HostsContainerMetrics) {
+	hc.metricsLock.Lock()
+	defer hc.metricsLock.Unlock()
+
+	return hc.metrics
+}
+
+// recordRefresh updates the refresh counters and timings after a refresh,
+// regardless of whether it succeeded.
+func (hc *HostsContainer) recordRefresh(d time.Duration, err error) {
+	hc.metricsLock.Lock()
+	defer hc.metricsLock.Unlock()
+
+	hc.metrics.RefreshesTotal++
+	hc.metrics.LastRefreshDuration = d
+	hc.metrics.RefreshDurationTotal += d
+	if err != nil {
+		hc.metrics.RefreshErrorsTotal++
+	}
+}
+
+// recordParseError increments the count of files that failed to be parsed
+// during a refresh.
+func (hc *HostsContainer) recordParseError() {
+	hc.metricsLock.Lock()
+	defer hc.metricsLock.Unlock()
+
+	hc.metrics.ParseErrorsTotal++
+}
+
+// recordRuleCounts sets the current rule-count gauges to the counts
+// generated by hp, and adds its duplicate count to the cumulative metric.
+// hp rebuilds the whole rule set from scratch on every refresh that
+// produces a change, so the rule counts are overwritten, not accumulated;
+// otherwise they'd re-count every existing rule on each such refresh.
+func (hc *HostsContainer) recordRuleCounts(hp *hostsParser) {
+	hc.metricsLock.Lock()
+	defer hc.metricsLock.Unlock()
+
+	hc.metrics.RulesA = hp.rulesA
+	hc.metrics.RulesAAAA = hp.rulesAAAA
+	hc.metrics.RulesPTR = hp.rulesPTR
+	hc.metrics.RulesCNAME = hp.rulesCNAME
+	hc.metrics.DuplicatesTotal += hp.duplicates
+}
+
 // pathsToPatterns converts paths into patterns compatible with fs.Glob.
 func pathsToPatterns(fsys fs.FS, paths []string) (patterns []string, err error) {
 	for i, p := range paths {
@@ -240,6 +498,11 @@ func (hc *HostsContainer) handleEvents() {
 
 	defer close(hc.updates)
 
+	var tickerC <-chan time.Time
+	if hc.ticker != nil {
+		tickerC = hc.ticker.C
+	}
+
 	ok, eventsCh := true, hc.w.Events()
 	for ok {
 		select {
@@ -250,9 +513,28 @@ func (hc *HostsContainer) handleEvents() {
 				continue
 			}
 
+			// aghos.FSWatcher doesn't report which path changed, so a raw
+			// fsnotify event must force a full rescan; only the ticker
+			// path, whose onTick already knows which sources it fetched,
+			// can name the changed files explicitly.  Drop the cache so
+			// that refresh re-reads every matched file from disk instead
+			// of serving stale, cached lines for files it can't name.
+			for f := range hc.fileCache {
+				delete(hc.fileCache, f)
+			}
+
 			if err := hc.refresh(); err != nil {
 				log.Error("%s: %s", hostsContainerPref, err)
 			}
+		case <-tickerC:
+			var changed []string
+			if hc.onTick != nil {
+				changed = hc.onTick()
+			}
+
+			if err := hc.refresh(changed...); err != nil {
+				log.Error("%s: %s", hostsContainerPref, err)
+			}
 		case _, ok = <-hc.done:
 			// Go on.
 		}
@@ -265,19 +547,93 @@ type ipRules struct {
 	rule string
 	// rulePtr is the PTR $dnsrewrite rule.
 	rulePtr string
-	// ip is the IP address related to the rules.
+	// host is the hostname or wildcard domain the rules were generated for.
+	// It's only used to build a readable translation, see translations.
+	host string
+	// ip is the IP address related to the rules.  It's nil for negated
+	// entries, which don't carry an address.
 	ip net.IP
+	// sourceFile is the path to the file the rule was parsed from.
+	sourceFile string
+	// lineNo is the 1-based number of the line within sourceFile the rule
+	// was parsed from.
+	lineNo int
+	// ttl is the TTL parsed from a "# ttl=N" comment, or zero if the line
+	// didn't have one.  It's not part of the generated $dnsrewrite rule,
+	// since that syntax has no TTL modifier; it's surfaced through
+	// requestMatcher.Translate instead, see translation.ttl.
+	ttl uint32
+}
+
+// HostsExtensions enables hosts(5) syntax extensions recognized by
+// hostsParser beyond the standard grammar described in man hosts(5).  All
+// extensions are opt-in and disabled by default.
+type HostsExtensions struct {
+	// Wildcards makes hostnames like "*.corp.lan" match the domain and all
+	// of its subdomains instead of only the exact name.
+	Wildcards bool
+
+	// Negation makes a leading "!" on a host produce an NXDOMAIN rule for
+	// it instead of an address mapping, allowing blocklists to be mixed
+	// into hosts files.
+	Negation bool
+
+	// TTL makes a trailing "# ttl=N" comment carry a TTL for the rules
+	// generated from that line.  It isn't baked into the generated
+	// $dnsrewrite rule, which has no TTL modifier of its own; it's exposed
+	// through requestMatcher.Translate for the caller to apply when
+	// constructing the actual DNS response.
+	TTL bool
+}
+
+// hostsLine is a single parsed, not yet merged, line read from a hosts file.
+// It's cached per file so that unchanged files don't need to be re-read and
+// re-parsed on every refresh.
+type hostsLine struct {
+	// ip is the address the hosts and wildcards are mapped to.  It's nil for
+	// a negated line, which doesn't carry an address.
+	ip net.IP
+	// hosts are the exact hostnames mapped to ip.
+	hosts []string
+	// wildcards are the wildcard domains, stripped of their "*." prefix,
+	// mapped to ip.
+	wildcards []string
+	// negated are the hostnames a leading "!" marked to resolve into
+	// NXDOMAIN.
+	negated []string
+	// ttl is the TTL parsed from a trailing "# ttl=N" comment, or zero if
+	// the line didn't have one.
+	ttl uint32
+	// lineNo is the 1-based number of the line within the source file.
+	lineNo int
 }
 
 // hostsParser is a helper type to parse rules from the operating system's hosts
 // file.  It exists for only a single refreshing session.
 type hostsParser struct {
-	// rulesBuilder builds the resulting rules list content.
+	// rulesBuilder builds the resulting rules list content for the exact
+	// hosts, i.e. the main/alias and negated entries.  It's kept in a
+	// separate rule storage and engine from wildcardBuilder so that an
+	// exact entry always takes precedence over a wildcard one covering the
+	// same name, regardless of urlfilter's own rule priority.
 	rulesBuilder *strings.Builder
 
+	// wildcardBuilder builds the resulting rules list content for the
+	// wildcard domain entries, see rulesBuilder.
+	wildcardBuilder *strings.Builder
+
 	// rules stores the rules for main hosts to generate translations.
 	rules []ipRules
 
+	// wildcardRules stores the rules generated for wildcard domains.  Unlike
+	// rules, entries here don't participate in main/alias merging: every
+	// wildcard domain gets its own independent rule.
+	wildcardRules []ipRules
+
+	// negatedRules stores the NXDOMAIN rules generated for hosts marked with
+	// a leading "!".
+	negatedRules []ipRules
+
 	// cnameSet prevents duplicating cname rules, e.g. same hostname for
 	// different IP versions.
 	cnameSet *stringutil.Set
@@ -285,6 +641,14 @@ type hostsParser struct {
 	// table stores only the unique IP-hostname pairs.  It's also sent to the
 	// updates channel afterwards.
 	table *netutil.IPMap
+
+	// rulesA, rulesAAAA, rulesPTR, and rulesCNAME count the rules of the
+	// matching kind generated so far, for HostsContainerMetrics.
+	rulesA, rulesAAAA, rulesPTR, rulesCNAME uint64
+
+	// duplicates counts the ip-host and alias pairs skipped as duplicates
+	// so far, for HostsContainerMetrics.
+	duplicates uint64
 }
 
 // newHostsParser creates a new *hostsParser with buffers of size taken from the
@@ -293,66 +657,172 @@ func (hc *HostsContainer) newHostsParser() (hp *hostsParser) {
 	lastLen := hc.last.Len()
 
 	return &hostsParser{
-		rulesBuilder: &strings.Builder{},
-		rules:        make([]ipRules, 0, lastLen),
-		cnameSet:     stringutil.NewSet(),
-		table:        netutil.NewIPMap(lastLen),
+		rulesBuilder:    &strings.Builder{},
+		wildcardBuilder: &strings.Builder{},
+		rules:           make([]ipRules, 0, lastLen),
+		cnameSet:        stringutil.NewSet(),
+		table:           netutil.NewIPMap(lastLen),
 	}
 }
 
-// parseFile is a aghos.FileWalker for parsing the files with hosts syntax.  It
-// never signs to stop walking and never returns any additional patterns.
+// parseLines reads and parses every line of r, which has the hosts syntax
+// plus whichever of ext is enabled, ignoring invalid lines.
 //
 // See man hosts(5).
-func (hp *hostsParser) parseFile(r io.Reader) (patterns []string, cont bool, err error) {
+func parseLines(r io.Reader, ext HostsExtensions) (lines []hostsLine, err error) {
 	s := bufio.NewScanner(r)
+
+	lineNo := 0
 	for s.Scan() {
-		ip, hosts := hp.parseLine(s.Text())
-		if ip == nil || len(hosts) == 0 {
+		lineNo++
+
+		hl, ok := parseLine(s.Text(), ext)
+		if !ok {
 			continue
 		}
 
-		hp.addPairs(ip, hosts)
+		hl.lineNo = lineNo
+		lines = append(lines, hl)
 	}
 
-	return nil, true, s.Err()
+	return lines, s.Err()
 }
 
-// parseLine parses the line having the hosts syntax ignoring invalid ones.
-func (hp *hostsParser) parseLine(line string) (ip net.IP, hosts []string) {
+// parseLine parses the line having the hosts syntax, plus whichever of ext
+// is enabled, ignoring invalid ones.  ok is false if the line carries no
+// usable data.
+func parseLine(line string, ext HostsExtensions) (hl hostsLine, ok bool) {
 	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return hostsLine{}, false
+	}
+
+	if ext.Negation && strings.HasPrefix(fields[0], "!") {
+		return parseNegatedLine(fields, ext)
+	}
+
 	if len(fields) < 2 {
-		return nil, nil
+		return hostsLine{}, false
 	}
 
-	if ip = net.ParseIP(fields[0]); ip == nil {
-		return nil, nil
+	ip := net.ParseIP(fields[0])
+	if ip == nil {
+		return hostsLine{}, false
 	}
 
-	for _, f := range fields[1:] {
+	hl.ip = ip
+
+	var comment string
+	for i, f := range fields[1:] {
 		hashIdx := strings.IndexByte(f, '#')
 		if hashIdx == 0 {
 			// The rest of the fields are a part of the comment so return.
+			comment = strings.Join(fields[1+i:], " ")
+
 			break
 		} else if hashIdx > 0 {
 			// Only a part of the field is a comment.
+			comment = f[hashIdx:]
 			f = f[:hashIdx]
 		}
 
-		// Make sure that invalid hosts aren't turned into rules.
-		//
-		// See https://github.com/AdguardTeam/AdGuardHome/issues/3946.
-		err := netutil.ValidateDomainName(f)
-		if err != nil {
-			log.Error("%s: host %q is invalid, ignoring", hostsContainerPref, f)
+		hl.addHost(f, ext)
+	}
+
+	if ext.TTL && comment != "" {
+		hl.ttl = parseTTLComment(comment)
+	}
+
+	if len(hl.hosts) == 0 && len(hl.wildcards) == 0 {
+		return hostsLine{}, false
+	}
+
+	return hl, true
+}
+
+// addHost validates f as either an exact hostname or, if ext.Wildcards is
+// enabled and f has a "*." prefix, a wildcard domain, and appends it to the
+// matching field of hl.  Invalid hosts are logged and ignored.
+//
+// See https://github.com/AdguardTeam/AdGuardHome/issues/3946.
+func (hl *hostsLine) addHost(f string, ext HostsExtensions) {
+	if ext.Wildcards && strings.HasPrefix(f, "*.") {
+		domain := strings.TrimPrefix(f, "*.")
+		if err := netutil.ValidateDomainName(domain); err != nil {
+			log.Error("%s: wildcard host %q is invalid, ignoring", hostsContainerPref, f)
+
+			return
+		}
+
+		hl.wildcards = append(hl.wildcards, domain)
+
+		return
+	}
+
+	if err := netutil.ValidateDomainName(f); err != nil {
+		log.Error("%s: host %q is invalid, ignoring", hostsContainerPref, f)
+
+		return
+	}
+
+	hl.hosts = append(hl.hosts, f)
+}
+
+// parseNegatedLine parses fields of a line whose first field has a leading
+// "!", i.e. one carrying no IP and marking every host in it to resolve into
+// NXDOMAIN.
+func parseNegatedLine(fields []string, ext HostsExtensions) (hl hostsLine, ok bool) {
+	fields[0] = strings.TrimPrefix(fields[0], "!")
+
+	var comment string
+	for i, f := range fields {
+		hashIdx := strings.IndexByte(f, '#')
+		if hashIdx == 0 {
+			comment = strings.Join(fields[i:], " ")
+
+			break
+		} else if hashIdx > 0 {
+			comment = f[hashIdx:]
+			f = f[:hashIdx]
+		}
+
+		if f == "" {
+			continue
+		}
+
+		if err := netutil.ValidateDomainName(f); err != nil {
+			log.Error("%s: negated host %q is invalid, ignoring", hostsContainerPref, f)
 
 			continue
 		}
 
-		hosts = append(hosts, f)
+		hl.negated = append(hl.negated, f)
+	}
+
+	if ext.TTL && comment != "" {
+		hl.ttl = parseTTLComment(comment)
 	}
 
-	return ip, hosts
+	return hl, len(hl.negated) > 0
+}
+
+// parseTTLComment parses a "# ttl=N" comment, which may still carry its
+// leading "#", into the TTL it specifies.  It returns 0 for a malformed or
+// unrelated comment.
+func parseTTLComment(comment string) (ttl uint32) {
+	comment = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(comment), "#"))
+	if !strings.HasPrefix(comment, "ttl=") {
+		return 0
+	}
+
+	v, err := strconv.ParseUint(strings.TrimPrefix(comment, "ttl="), 10, 32)
+	if err != nil {
+		log.Error("%s: invalid ttl comment %q: %s", hostsContainerPref, comment, err)
+
+		return 0
+	}
+
+	return uint32(v)
 }
 
 // Hosts is used to contain the main host and all it's aliases.
@@ -406,35 +876,102 @@ func (hp *hostsParser) add(ip net.IP, host string) (mainHost string) {
 }
 
 // addPair puts the pair of ip and host to the rules builder if needed.  For
-// each ip the first member of hosts will become the main one.
-func (hp *hostsParser) addPairs(ip net.IP, hosts []string) {
+// each ip the first member of hosts will become the main one.  sourceFile
+// and lineNo locate the line host was read from, and ttl is the TTL parsed
+// for the line; all are stored alongside the generated rules.
+func (hp *hostsParser) addPairs(ip net.IP, hosts []string, ttl uint32, sourceFile string, lineNo int) {
 	for _, host := range hosts {
 		switch mainHost := hp.add(ip, host); mainHost {
 		case "":
 			// This host is a duplicate.
+			hp.duplicates++
+
 			continue
 		case host:
 			// This host is main.
 			added, addedPtr := hp.writeMainRule(host, ip)
+			if added != "" {
+				if ip.To4() != nil {
+					hp.rulesA++
+				} else {
+					hp.rulesAAAA++
+				}
+			}
+			if addedPtr != "" {
+				hp.rulesPTR++
+			}
+
 			hp.rules = append(hp.rules, ipRules{
-				rule:    added,
-				rulePtr: addedPtr,
-				ip:      ip,
+				rule:       added,
+				rulePtr:    addedPtr,
+				host:       host,
+				ip:         ip,
+				sourceFile: sourceFile,
+				lineNo:     lineNo,
+				ttl:        ttl,
 			})
 		default:
 			// This host is an alias.
 			pair := fmt.Sprint(host, " ", mainHost)
 			if hp.cnameSet.Has(pair) {
+				hp.duplicates++
+
 				continue
 			}
 			hp.writeAliasRule(host, mainHost)
 			hp.cnameSet.Add(pair)
+			hp.rulesCNAME++
 		}
 
 		log.Debug("%s: added ip-host pair %q-%q", hostsContainerPref, ip, host)
 	}
 }
 
+// addWildcards writes wildcard domain rules mapping each of domains to ip.
+// Unlike addPairs, wildcard entries don't participate in main/alias merging:
+// every domain gets its own independent rule.  Wildcard rules are kept in
+// their own rule storage and engine, separate from exact and negated ones,
+// see hostsParser.wildcardBuilder; requestMatcher.MatchRequest consults it
+// only if the exact engine has no match, so an exact host for the same name
+// always takes precedence over a wildcard covering it.
+func (hp *hostsParser) addWildcards(ip net.IP, domains []string, ttl uint32, sourceFile string, lineNo int) {
+	for _, domain := range domains {
+		added := hp.writeWildcardRule(domain, ip)
+		if ip.To4() != nil {
+			hp.rulesA++
+		} else {
+			hp.rulesAAAA++
+		}
+
+		hp.wildcardRules = append(hp.wildcardRules, ipRules{
+			rule:       added,
+			host:       domain,
+			ip:         ip,
+			sourceFile: sourceFile,
+			lineNo:     lineNo,
+			ttl:        ttl,
+		})
+
+		log.Debug("%s: added wildcard %q for ip %q", hostsContainerPref, domain, ip)
+	}
+}
+
+// addNegated writes NXDOMAIN rules for each of hosts.
+func (hp *hostsParser) addNegated(hosts []string, ttl uint32, sourceFile string, lineNo int) {
+	for _, host := range hosts {
+		added := hp.writeNegatedRule(host)
+		hp.negatedRules = append(hp.negatedRules, ipRules{
+			rule:       added,
+			host:       host,
+			sourceFile: sourceFile,
+			lineNo:     lineNo,
+			ttl:        ttl,
+		})
+
+		log.Debug("%s: added negated host %q", hostsContainerPref, host)
+	}
+}
+
 // writeAliasRule writes the CNAME rule for the alias-host pair into internal
 // builders.
 func (hp *hostsParser) writeAliasRule(alias, host string) {
@@ -506,6 +1043,68 @@ func (hp *hostsParser) writeMainRule(host string, ip net.IP) (added, addedPtr st
 	return added, addedPtr
 }
 
+// writeWildcardRule writes the rule matching domain and all of its
+// subdomains to ip into internal builders.  Unlike writeMainRule, it doesn't
+// generate a PTR rule, since a wildcard can't be reversed into a single
+// hostname.
+func (hp *hostsParser) writeWildcardRule(domain string, ip net.IP) (added string) {
+	const (
+		nl = "\n"
+
+		rwSuccess = "^$dnsrewrite=NOERROR;"
+
+		modLen = len("||") + len(rwSuccess) + len(";")
+	)
+
+	var qtype string
+	if ip.To4() != nil {
+		qtype = "A"
+	} else {
+		qtype = "AAAA"
+	}
+
+	ipStr := ip.String()
+
+	ruleBuilder := &strings.Builder{}
+	ruleBuilder.Grow(modLen + len(domain) + len(qtype) + len(ipStr))
+	stringutil.WriteToBuilder(
+		ruleBuilder,
+		"||",
+		domain,
+		rwSuccess,
+		qtype,
+		";",
+		ipStr,
+	)
+	added = ruleBuilder.String()
+
+	hp.wildcardBuilder.Grow(len(added) + len(nl))
+	stringutil.WriteToBuilder(hp.wildcardBuilder, added, nl)
+
+	return added
+}
+
+// writeNegatedRule writes the NXDOMAIN rule for host into internal builders.
+func (hp *hostsParser) writeNegatedRule(host string) (added string) {
+	const (
+		nl = "\n"
+
+		rwFail = "$dnsrewrite=NXDOMAIN"
+
+		modLen = len("||") + len(rules.MaskSeparator) + len(rwFail)
+	)
+
+	ruleBuilder := &strings.Builder{}
+	ruleBuilder.Grow(modLen + len(host))
+	stringutil.WriteToBuilder(ruleBuilder, "||", host, rules.MaskSeparator, rwFail)
+	added = ruleBuilder.String()
+
+	hp.rulesBuilder.Grow(len(added) + len(nl))
+	stringutil.WriteToBuilder(hp.rulesBuilder, added, nl)
+
+	return added
+}
+
 // equalSet returns true if the internal hosts table just parsed equals target.
 func (hp *hostsParser) equalSet(target *netutil.IPMap) (ok bool) {
 	if target == nil {
@@ -554,24 +1153,24 @@ func (hp *hostsParser) sendUpd(ch chan *netutil.IPMap) {
 	}
 }
 
-// newStrg creates a new rules storage from parsed data.
-func (hp *hostsParser) newStrg(id int) (s *filterlist.RuleStorage, err error) {
+// newStrg creates a new rules storage containing rulesText.
+func newStrg(id int, rulesText string) (s *filterlist.RuleStorage, err error) {
 	return filterlist.NewRuleStorage([]filterlist.RuleList{&filterlist.StringRuleList{
 		ID:             id,
-		RulesText:      hp.rulesBuilder.String(),
+		RulesText:      rulesText,
 		IgnoreCosmetic: true,
 	}})
 }
 
 // translations generates the map to translate $dnsrewrite rules to
 // hosts-syntax ones.
-func (hp *hostsParser) translations() (trans map[string]string) {
-	l := len(hp.rules)
+func (hp *hostsParser) translations() (trans map[string]translation) {
+	l := len(hp.rules) + len(hp.wildcardRules) + len(hp.negatedRules)
 	if l == 0 {
 		return nil
 	}
 
-	trans = make(map[string]string, l*2)
+	trans = make(map[string]translation, l*2)
 	for _, r := range hp.rules {
 		v, ok := hp.table.Get(r.ip)
 		if !ok {
@@ -585,40 +1184,195 @@ func (hp *hostsParser) translations() (trans map[string]string) {
 		}
 
 		strs := append([]string{r.ip.String(), hosts.Main}, hosts.Aliases.Values()...)
-		hostsLine := strings.Join(strs, " ")
-		trans[r.rule], trans[r.rulePtr] = hostsLine, hostsLine
+		tr := translation{
+			line:       strings.Join(strs, " "),
+			sourceFile: r.sourceFile,
+			ttl:        r.ttl,
+		}
+		trans[r.rule] = tr
+		trans[r.rulePtr] = tr
+	}
+
+	for _, r := range hp.wildcardRules {
+		trans[r.rule] = translation{
+			line:       fmt.Sprint(r.ip, " *.", r.host),
+			sourceFile: r.sourceFile,
+			ttl:        r.ttl,
+		}
+	}
+
+	for _, r := range hp.negatedRules {
+		trans[r.rule] = translation{
+			line:       fmt.Sprint("!", r.host),
+			sourceFile: r.sourceFile,
+			ttl:        r.ttl,
+		}
 	}
 
 	return trans
 }
 
-// refresh gets the data from specified files and propagates the updates if
-// needed.
-//
-// TODO(e.burkov):  Accept a parameter to specify the files to refresh.
-func (hc *HostsContainer) refresh() (err error) {
+// snapshot builds the read-only view of the merged table returned by
+// Snapshot, one entry per IP address and its main host, attributing it to the
+// file and line the main host was parsed from.
+func (hp *hostsParser) snapshot() (entries []HostEntry) {
+	if len(hp.rules) == 0 {
+		return nil
+	}
+
+	entries = make([]HostEntry, 0, len(hp.rules))
+	for _, r := range hp.rules {
+		v, ok := hp.table.Get(r.ip)
+		if !ok {
+			continue
+		}
+
+		hosts, ok := v.(*Hosts)
+		if !ok {
+			continue
+		}
+
+		entries = append(entries, HostEntry{
+			IP:         r.ip,
+			Main:       hosts.Main,
+			Aliases:    hosts.Aliases.Values(),
+			SourceFile: r.sourceFile,
+			LineNo:     r.lineNo,
+		})
+	}
+
+	return entries
+}
+
+// matchedFiles returns the sorted, deduplicated list of paths currently
+// matched by hc.patterns.
+func (hc *HostsContainer) matchedFiles() (files []string, err error) {
+	set := stringutil.NewSet()
+	for _, p := range hc.patterns {
+		var matches []string
+		matches, err = fs.Glob(hc.fsys, p)
+		if err != nil {
+			return nil, fmt.Errorf("globbing pattern %q: %w", p, err)
+		}
+
+		set.Add(matches...)
+	}
+
+	files = set.Values()
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// parseFileLines reads and parses the hosts-syntax file at name.
+func (hc *HostsContainer) parseFileLines(name string) (lines []hostsLine, err error) {
+	f, err := hc.fsys.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("opening %q: %w", name, err)
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	lines, err = parseLines(f, hc.ext)
+	if err != nil {
+		return nil, fmt.Errorf("scanning %q: %w", name, err)
+	}
+
+	return lines, nil
+}
+
+// refresh gets the data from the specified files and propagates the updates
+// if needed.  changed is the set of paths known to have changed, e.g. those
+// a remote source's downloader just fetched; only those files are re-read
+// from disk, the rest of the matched files are taken from hc.fileCache.  A
+// path that hasn't been cached yet is read unconditionally regardless of
+// changed, which also covers the initial load.  With no changed paths, every
+// already cached file is taken from the cache.  A raw fsnotify event from hc.w
+// carries no path of its own, so in that case handleEvents empties
+// hc.fileCache before calling refresh, forcing a full rescan.
+func (hc *HostsContainer) refresh(changed ...string) (err error) {
+	start := time.Now()
+	defer func() { hc.recordRefresh(time.Since(start), err) }()
+
 	log.Debug("%s: refreshing", hostsContainerPref)
 
+	files, err := hc.matchedFiles()
+	if err != nil {
+		return fmt.Errorf("refreshing: %w", err)
+	}
+
+	matched := stringutil.NewSet(files...)
+	for cached := range hc.fileCache {
+		if !matched.Has(cached) {
+			delete(hc.fileCache, cached)
+		}
+	}
+
+	changedSet := stringutil.NewSet(changed...)
+	for _, f := range files {
+		_, ok := hc.fileCache[f]
+		if ok && !changedSet.Has(f) {
+			continue
+		}
+
+		var lines []hostsLine
+		lines, err = hc.parseFileLines(f)
+		if err != nil {
+			hc.recordParseError()
+
+			return fmt.Errorf("refreshing: %w", err)
+		}
+
+		hc.fileCache[f] = lines
+	}
+
 	hp := hc.newHostsParser()
-	if _, err = aghos.FileWalker(hp.parseFile).Walk(hc.fsys, hc.patterns...); err != nil {
-		return fmt.Errorf("refreshing : %w", err)
+	for _, f := range files {
+		for _, l := range hc.fileCache[f] {
+			if len(l.negated) > 0 {
+				hp.addNegated(l.negated, l.ttl, f, l.lineNo)
+
+				continue
+			}
+
+			if len(l.hosts) > 0 {
+				hp.addPairs(l.ip, l.hosts, l.ttl, f, l.lineNo)
+			}
+
+			if len(l.wildcards) > 0 {
+				hp.addWildcards(l.ip, l.wildcards, l.ttl, f, l.lineNo)
+			}
+		}
 	}
 
-	if hp.equalSet(hc.last) {
+	// The table only tracks exact hosts, so it doesn't reflect changes to
+	// wildcard or negated entries.  Compare the full generated rule set as
+	// well to make sure those aren't missed.
+	rulesText := hp.rulesBuilder.String() + hp.wildcardBuilder.String()
+	tableChanged := !hp.equalSet(hc.last)
+	if !tableChanged && rulesText == hc.lastRules {
 		log.Debug("%s: no changes detected", hostsContainerPref)
 
 		return nil
 	}
-	defer hp.sendUpd(hc.updates)
 
-	hc.last = hp.table.ShallowClone()
+	hc.lastRules = rulesText
+	if tableChanged {
+		defer hp.sendUpd(hc.updates)
 
-	var rulesStrg *filterlist.RuleStorage
-	if rulesStrg, err = hp.newStrg(hc.listID); err != nil {
+		hc.last = hp.table.ShallowClone()
+	}
+
+	var rulesStrg, wildcardStrg *filterlist.RuleStorage
+	if rulesStrg, err = newStrg(hc.listID, hp.rulesBuilder.String()); err != nil {
 		return fmt.Errorf("initializing rules storage: %w", err)
 	}
 
-	hc.resetEng(rulesStrg, hp.translations())
+	if wildcardStrg, err = newStrg(hc.listID, hp.wildcardBuilder.String()); err != nil {
+		return fmt.Errorf("initializing wildcard rules storage: %w", err)
+	}
+
+	hc.recordRuleCounts(hp)
+	hc.resetEng(rulesStrg, wildcardStrg, hp.translations(), hp.snapshot())
 
 	return nil
 }
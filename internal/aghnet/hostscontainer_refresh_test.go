@@ -0,0 +1,102 @@
+package aghnet
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeFSWatcher is a no-op aghos.FSWatcher used to drive HostsContainer in
+// tests without touching the real file system notification machinery.
+type fakeFSWatcher struct {
+	events chan struct{}
+}
+
+func newFakeFSWatcher() (w *fakeFSWatcher) {
+	return &fakeFSWatcher{
+		events: make(chan struct{}),
+	}
+}
+
+// Events implements the aghos.FSWatcher interface for *fakeFSWatcher.
+func (w *fakeFSWatcher) Events() (events <-chan struct{}) { return w.events }
+
+// Add implements the aghos.FSWatcher interface for *fakeFSWatcher.
+func (w *fakeFSWatcher) Add(name string) (err error) { return nil }
+
+// Close implements the aghos.FSWatcher interface for *fakeFSWatcher.
+func (w *fakeFSWatcher) Close() (err error) { return nil }
+
+func TestHostsContainer_refresh_cacheInvalidation(t *testing.T) {
+	fsys := fstest.MapFS{
+		"hosts": &fstest.MapFile{Data: []byte("1.2.3.4 host.example\n")},
+	}
+
+	hc, err := NewHostsContainer(0, fsys, newFakeFSWatcher(), HostsExtensions{}, "hosts")
+	require.NoError(t, err)
+	defer func() { assert.NoError(t, hc.Close()) }()
+
+	entries := hc.Snapshot()
+	require.Len(t, entries, 1)
+	assert.Equal(t, "host.example", entries[0].Main)
+
+	require.Contains(t, hc.fileCache, "hosts")
+	cachedBefore := hc.fileCache["hosts"]
+
+	// Calling refresh directly without naming "hosts" in its changed
+	// arguments must leave the cached parse, and so the snapshot, as is;
+	// that's the contract the ticker path relies on.  The fsnotify path
+	// doesn't get to rely on it, see TestHostsContainer_handleEvents_fullRescan.
+	fsys["hosts"].Data = []byte("5.6.7.8 other.example\n")
+
+	require.NoError(t, hc.refresh())
+	assert.Equal(t, cachedBefore, hc.fileCache["hosts"])
+
+	entries = hc.Snapshot()
+	require.Len(t, entries, 1)
+	assert.Equal(t, "host.example", entries[0].Main)
+
+	// Naming "hosts" as changed forces it to be re-read, invalidating the
+	// stale cache entry.
+	require.NoError(t, hc.refresh("hosts"))
+	assert.NotEqual(t, cachedBefore, hc.fileCache["hosts"])
+
+	entries = hc.Snapshot()
+	require.Len(t, entries, 1)
+	assert.Equal(t, "other.example", entries[0].Main)
+}
+
+func TestHostsContainer_handleEvents_fullRescan(t *testing.T) {
+	fsys := fstest.MapFS{
+		"hosts": &fstest.MapFile{Data: []byte("1.2.3.4 host.example\n")},
+	}
+
+	w := newFakeFSWatcher()
+	hc, err := NewHostsContainer(0, fsys, w, HostsExtensions{}, "hosts")
+	require.NoError(t, err)
+	defer func() { assert.NoError(t, hc.Close()) }()
+
+	entries := hc.Snapshot()
+	require.Len(t, entries, 1)
+	assert.Equal(t, "host.example", entries[0].Main)
+
+	// Drain the update the initial load already queued, so the receive
+	// below can only be satisfied by the update the event below triggers.
+	_, ok := <-hc.Upd()
+	require.True(t, ok)
+
+	// A raw fsnotify event carries no path, so handleEvents must drop the
+	// cache and force every matched file to be re-read, not just skip
+	// straight to comparing against the stale cached parse.
+	fsys["hosts"].Data = []byte("5.6.7.8 other.example\n")
+	w.events <- struct{}{}
+
+	_, ok = <-hc.Upd()
+	require.True(t, ok)
+
+	entries = hc.Snapshot()
+	require.Len(t, entries, 1)
+	assert.Equal(t, "other.example", entries[0].Main)
+}
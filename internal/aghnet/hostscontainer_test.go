@@ -0,0 +1,131 @@
+package aghnet
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/stringutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestHostsParser returns a *hostsParser with empty, freshly initialized
+// buffers, ready to have rules added to it directly, bypassing parseLines.
+func newTestHostsParser() (hp *hostsParser) {
+	return &hostsParser{
+		rulesBuilder:    &strings.Builder{},
+		wildcardBuilder: &strings.Builder{},
+		cnameSet:        stringutil.NewSet(),
+		table:           netutil.NewIPMap(0),
+	}
+}
+
+func TestHostsParser_writeWildcardRule(t *testing.T) {
+	hp := newTestHostsParser()
+
+	hp.addWildcards(net.ParseIP("1.2.3.4"), []string{"corp.lan"}, 0, "hosts", 1)
+
+	// The rule must use a single domain anchor, not a doubled one, or it
+	// won't match "*.corp.lan" at all.
+	assert.Equal(t, "||corp.lan^$dnsrewrite=NOERROR;A;1.2.3.4\n", hp.wildcardBuilder.String())
+	assert.Equal(t, "", hp.rulesBuilder.String())
+}
+
+func TestHostsParser_writeNegatedRule(t *testing.T) {
+	hp := newTestHostsParser()
+
+	hp.addNegated([]string{"blocked.example"}, 0, "hosts", 1)
+
+	assert.Equal(t, "||blocked.example^$dnsrewrite=NXDOMAIN\n", hp.rulesBuilder.String())
+}
+
+func TestHostsParser_ttlSurfacedByTranslations(t *testing.T) {
+	hp := newTestHostsParser()
+
+	hp.addPairs(net.ParseIP("1.2.3.4"), []string{"host.example"}, 120, "hosts", 1)
+	hp.addWildcards(net.ParseIP("1.2.3.5"), []string{"wild.example"}, 60, "hosts", 2)
+	hp.addNegated([]string{"blocked.example"}, 30, "hosts", 3)
+
+	trans := hp.translations()
+	require.Len(t, hp.rules, 1)
+
+	exact, ok := trans[hp.rules[0].rule]
+	require.True(t, ok)
+	assert.EqualValues(t, 120, exact.ttl)
+
+	require.Len(t, hp.wildcardRules, 1)
+	wildcard, ok := trans[hp.wildcardRules[0].rule]
+	require.True(t, ok)
+	assert.EqualValues(t, 60, wildcard.ttl)
+
+	require.Len(t, hp.negatedRules, 1)
+	negated, ok := trans[hp.negatedRules[0].rule]
+	require.True(t, ok)
+	assert.EqualValues(t, 30, negated.ttl)
+}
+
+func TestParseLine_wildcardsNegationTTL(t *testing.T) {
+	ext := HostsExtensions{
+		Wildcards: true,
+		Negation:  true,
+		TTL:       true,
+	}
+
+	testCases := []struct {
+		name          string
+		line          string
+		wantHosts     []string
+		wantWildcards []string
+		wantNegated   []string
+		wantTTL       uint32
+		wantOK        bool
+	}{{
+		name:      "simple",
+		line:      "1.2.3.4 host.example",
+		wantHosts: []string{"host.example"},
+		wantOK:    true,
+	}, {
+		name:          "wildcard",
+		line:          "1.2.3.4 *.corp.lan",
+		wantWildcards: []string{"corp.lan"},
+		wantOK:        true,
+	}, {
+		name:        "negated",
+		line:        "!blocked.example",
+		wantNegated: []string{"blocked.example"},
+		wantOK:      true,
+	}, {
+		name:      "ttl_comment",
+		line:      "1.2.3.4 host.example # ttl=120",
+		wantHosts: []string{"host.example"},
+		wantTTL:   120,
+		wantOK:    true,
+	}, {
+		name:      "invalid_ttl_comment",
+		line:      "1.2.3.4 host.example # ttl=nope",
+		wantHosts: []string{"host.example"},
+		wantTTL:   0,
+		wantOK:    true,
+	}, {
+		name:   "empty",
+		line:   "",
+		wantOK: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			hl, ok := parseLine(tc.line, ext)
+			require.Equal(t, tc.wantOK, ok)
+			if !ok {
+				return
+			}
+
+			assert.Equal(t, tc.wantHosts, hl.hosts)
+			assert.Equal(t, tc.wantWildcards, hl.wildcards)
+			assert.Equal(t, tc.wantNegated, hl.negated)
+			assert.EqualValues(t, tc.wantTTL, hl.ttl)
+		})
+	}
+}
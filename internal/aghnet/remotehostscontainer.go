@@ -0,0 +1,392 @@
+package aghnet
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// defaultRemoteHostsMaxBodySize is the default cap on the size of a single
+// downloaded remote hosts list, protecting against a misbehaving or
+// malicious source exhausting memory.
+const defaultRemoteHostsMaxBodySize = 64 * 1024 * 1024
+
+// maxRemoteHostsBackoff is the cap on the exponential backoff applied to a
+// remote source after a server error.
+const maxRemoteHostsBackoff = 30 * time.Minute
+
+// remoteHostsFileName returns the name under which the ith remote source's
+// contents are stored in the in-memory file system fed to the underlying
+// HostsContainer.
+func remoteHostsFileName(i int) (name string) {
+	return fmt.Sprintf("remote-hosts-%d", i)
+}
+
+// remoteSource tracks the caching and backoff state of a single remote
+// hosts list.
+type remoteSource struct {
+	// url is the address the list is downloaded from.
+	url string
+
+	// name is the file name its contents are stored under in rfs.
+	name string
+
+	// etag is the ETag reported by the last successful, non-304 download,
+	// if any.
+	etag string
+
+	// lastModified is the Last-Modified reported by the last successful,
+	// non-304 download, if any.
+	lastModified string
+
+	// bodyHash is the SHA-256 hash of the body of the last successful,
+	// non-304 download, used to detect a change for a source whose
+	// responses carry neither ETag nor Last-Modified.
+	bodyHash [sha256.Size]byte
+
+	// backoff is the current backoff duration applied after a server
+	// error.  It's reset to zero on a successful request.
+	backoff time.Duration
+
+	// nextAttempt is the earliest time a request to url should be retried
+	// after a server error.  The zero value means url may be requested
+	// immediately.
+	nextAttempt time.Time
+}
+
+// remoteFileInfo implements fs.FileInfo for a remoteFile.
+type remoteFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// Name implements the fs.FileInfo interface for *remoteFileInfo.
+func (fi *remoteFileInfo) Name() string { return fi.name }
+
+// Size implements the fs.FileInfo interface for *remoteFileInfo.
+func (fi *remoteFileInfo) Size() int64 { return fi.size }
+
+// Mode implements the fs.FileInfo interface for *remoteFileInfo.
+func (fi *remoteFileInfo) Mode() fs.FileMode { return 0o444 }
+
+// ModTime implements the fs.FileInfo interface for *remoteFileInfo.
+func (fi *remoteFileInfo) ModTime() time.Time { return fi.modTime }
+
+// IsDir implements the fs.FileInfo interface for *remoteFileInfo.
+func (fi *remoteFileInfo) IsDir() bool { return false }
+
+// Sys implements the fs.FileInfo interface for *remoteFileInfo.
+func (fi *remoteFileInfo) Sys() interface{} { return nil }
+
+// remoteFile implements fs.File over an in-memory byte slice downloaded from
+// a remote source.
+type remoteFile struct {
+	*bytes.Reader
+
+	info *remoteFileInfo
+}
+
+// Stat implements the fs.File interface for *remoteFile.
+func (f *remoteFile) Stat() (fi fs.FileInfo, err error) { return f.info, nil }
+
+// Close implements the fs.File interface for *remoteFile.
+func (f *remoteFile) Close() (err error) { return nil }
+
+// remoteFS is an in-memory fs.FS populated by RemoteHostsContainer's
+// downloader, one file per configured remote source.
+type remoteFS struct {
+	mu    *sync.RWMutex
+	files map[string][]byte
+}
+
+// newRemoteFS returns a new empty *remoteFS.
+func newRemoteFS() (rfs *remoteFS) {
+	return &remoteFS{
+		mu:    &sync.RWMutex{},
+		files: map[string][]byte{},
+	}
+}
+
+// set stores data under name, overwriting any previous contents.
+func (rfs *remoteFS) set(name string, data []byte) {
+	rfs.mu.Lock()
+	defer rfs.mu.Unlock()
+
+	rfs.files[name] = data
+}
+
+// Open implements the fs.FS interface for *remoteFS.
+func (rfs *remoteFS) Open(name string) (f fs.File, err error) {
+	rfs.mu.RLock()
+	defer rfs.mu.RUnlock()
+
+	data, ok := rfs.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return &remoteFile{
+		Reader: bytes.NewReader(data),
+		info:   &remoteFileInfo{name: name, size: int64(len(data))},
+	}, nil
+}
+
+// unionFS combines a local and a remote file system, preferring the remote
+// one on naming conflicts.
+type unionFS struct {
+	local  fs.FS
+	remote fs.FS
+}
+
+// Open implements the fs.FS interface for *unionFS.
+func (u *unionFS) Open(name string) (f fs.File, err error) {
+	f, err = u.remote.Open(name)
+	if err == nil {
+		return f, nil
+	}
+
+	return u.local.Open(name)
+}
+
+// RemoteHostsContainer extends HostsContainer with hosts lists downloaded
+// over HTTP(S), e.g. the Steven Black or someonewhocares unified lists, so
+// that a small local hosts file and large curated blocklists can be served
+// by the same subsystem.  Remote sources are refreshed on a timer, reusing
+// HostsContainer's fsnotify-driven event loop, and honor ETag/Last-Modified
+// caching so an unchanged source costs only a conditional request.
+type RemoteHostsContainer struct {
+	*HostsContainer
+
+	// client performs the downloads.
+	client *http.Client
+
+	// rfs is the in-memory file system the downloaded sources are stored
+	// in, and which HostsContainer parses alongside the local one.
+	rfs *remoteFS
+
+	// sources are the configured remote sources, in the same order as the
+	// URLs passed to NewRemoteHostsContainer.
+	sources []*remoteSource
+
+	// errs receives a download error for a single source whenever one
+	// occurs, without interrupting the refresh of the rest.
+	errs chan error
+
+	// maxBodySize is the cap on the size of a single downloaded source.
+	maxBodySize int64
+}
+
+// NewRemoteHostsContainer creates a *RemoteHostsContainer that, in addition
+// to watching paths in fsys the same way NewHostsContainer does, downloads
+// the hosts lists at urls and merges them in.  client is used for the
+// downloads; if nil, a client with a reasonable default timeout is used.
+// refreshInterval configures how often the remote sources are re-requested;
+// it must be positive.  listID, fsys, w, ext and paths are as in
+// NewHostsContainer, except that paths may be empty if urls isn't.
+func NewRemoteHostsContainer(
+	listID int,
+	fsys fs.FS,
+	w aghos.FSWatcher,
+	ext HostsExtensions,
+	client *http.Client,
+	refreshInterval time.Duration,
+	urls []string,
+	paths ...string,
+) (rhc *RemoteHostsContainer, err error) {
+	if len(urls) == 0 {
+		return nil, ErrNoHostsPaths
+	}
+
+	if refreshInterval <= 0 {
+		return nil, fmt.Errorf("%s: refresh interval must be positive, got %s", hostsContainerPref, refreshInterval)
+	}
+
+	if client == nil {
+		client = &http.Client{
+			Timeout: 30 * time.Second,
+		}
+	}
+
+	rhc = &RemoteHostsContainer{
+		client:      client,
+		rfs:         newRemoteFS(),
+		sources:     make([]*remoteSource, len(urls)),
+		errs:        make(chan error, len(urls)),
+		maxBodySize: defaultRemoteHostsMaxBodySize,
+	}
+
+	remotePaths := make([]string, len(urls))
+	for i, u := range urls {
+		name := remoteHostsFileName(i)
+		rhc.sources[i] = &remoteSource{url: u, name: name}
+		remotePaths[i] = name
+	}
+
+	// Populate the in-memory file system before the first refresh so that
+	// whatever sources succeed are available right from the start.
+	for _, src := range rhc.sources {
+		if _, dErr := rhc.download(src); dErr != nil {
+			log.Error("%s: initial download of %s: %s", hostsContainerPref, src.url, dErr)
+			rhc.reportError(src, dErr)
+		}
+	}
+
+	combined := &unionFS{local: fsys, remote: rhc.rfs}
+
+	rhc.HostsContainer, err = newHostsContainer(
+		listID,
+		combined,
+		w,
+		ext,
+		refreshInterval,
+		rhc.downloadAll,
+		remotePaths,
+		paths...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return rhc, nil
+}
+
+// Errors returns the channel into which a download error for an individual
+// remote source is sent whenever one occurs.  Errors are dropped, not
+// blocked on, if nobody is reading from the channel, so as not to stall
+// refreshes of the other sources.
+func (rhc *RemoteHostsContainer) Errors() (errs <-chan error) {
+	return rhc.errs
+}
+
+// reportError sends err for src's URL into rhc.errs, dropping it if the
+// channel is full.
+func (rhc *RemoteHostsContainer) reportError(src *remoteSource, err error) {
+	wrapped := fmt.Errorf("%s: %w", src.url, err)
+
+	select {
+	case rhc.errs <- wrapped:
+		// Go on.
+	default:
+		log.Debug("%s: errors channel is full, dropping: %s", hostsContainerPref, wrapped)
+	}
+}
+
+// downloadAll re-downloads every remote source whose backoff has elapsed and
+// returns the names of the ones whose contents actually changed, i.e. that
+// HostsContainer's refresh should force to be re-read.  It's used as the
+// onTick hook of the underlying HostsContainer.
+func (rhc *RemoteHostsContainer) downloadAll() (changed []string) {
+	for _, src := range rhc.sources {
+		srcChanged, err := rhc.download(src)
+		if err != nil {
+			log.Error("%s: downloading %s: %s", hostsContainerPref, src.url, err)
+			rhc.reportError(src, err)
+
+			continue
+		}
+
+		if srcChanged {
+			changed = append(changed, src.name)
+		}
+	}
+
+	return changed
+}
+
+// download requests src.url, honoring the previously seen ETag and
+// Last-Modified, and stores the body in rhc.rfs on success.  A 304 response
+// is treated as no change.  A 5xx response backs src off with jitter before
+// the next attempt.  changed reports whether the downloaded body actually
+// differs from the last one stored for src, determined by comparing
+// src.bodyHash rather than relying solely on ETag/Last-Modified, since a
+// source may send neither header.
+func (rhc *RemoteHostsContainer) download(src *remoteSource) (changed bool, err error) {
+	if now := time.Now(); !src.nextAttempt.IsZero() && now.Before(src.nextAttempt) {
+		log.Debug("%s: %s: still backed off, skipping", hostsContainerPref, src.url)
+
+		return false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rhc.client.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src.url, nil)
+	if err != nil {
+		return false, fmt.Errorf("creating request: %w", err)
+	}
+
+	if src.etag != "" {
+		req.Header.Set("If-None-Match", src.etag)
+	}
+	if src.lastModified != "" {
+		req.Header.Set("If-Modified-Since", src.lastModified)
+	}
+
+	resp, err := rhc.client.Do(req)
+	if err != nil {
+		rhc.backOff(src)
+
+		return false, fmt.Errorf("requesting: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		log.Debug("%s: %s: not modified", hostsContainerPref, src.url)
+		src.backoff, src.nextAttempt = 0, time.Time{}
+
+		return false, nil
+	case resp.StatusCode >= 500:
+		rhc.backOff(src)
+
+		return false, fmt.Errorf("server error: %s", resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return false, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, rhc.maxBodySize+1))
+	if err != nil {
+		return false, fmt.Errorf("reading body: %w", err)
+	} else if int64(len(body)) > rhc.maxBodySize {
+		return false, fmt.Errorf("body exceeds %d bytes", rhc.maxBodySize)
+	}
+
+	hash := sha256.Sum256(body)
+	changed = hash != src.bodyHash
+
+	rhc.rfs.set(src.name, body)
+	src.bodyHash = hash
+	src.etag = resp.Header.Get("ETag")
+	src.lastModified = resp.Header.Get("Last-Modified")
+	src.backoff, src.nextAttempt = 0, time.Time{}
+
+	return changed, nil
+}
+
+// backOff doubles src's backoff, capped at maxRemoteHostsBackoff, jitters it
+// by up to 20%, and sets nextAttempt accordingly.
+func (rhc *RemoteHostsContainer) backOff(src *remoteSource) {
+	if src.backoff == 0 {
+		src.backoff = time.Minute
+	} else {
+		src.backoff *= 2
+		if src.backoff > maxRemoteHostsBackoff {
+			src.backoff = maxRemoteHostsBackoff
+		}
+	}
+
+	jitter := time.Duration(rand.Int63n(int64(src.backoff) / 5))
+	src.nextAttempt = time.Now().Add(src.backoff + jitter)
+}
@@ -0,0 +1,115 @@
+package aghnet
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteHostsContainer_etagCaching(t *testing.T) {
+	var reqs int32
+	const etag = `"v1"`
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&reqs, 1)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+
+			return
+		}
+
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte("1.2.3.4 remote.example\n"))
+	}))
+	defer srv.Close()
+
+	rhc, err := NewRemoteHostsContainer(
+		0,
+		fstest.MapFS{},
+		newFakeFSWatcher(),
+		HostsExtensions{},
+		nil,
+		time.Hour,
+		[]string{srv.URL},
+	)
+	require.NoError(t, err)
+	defer func() { assert.NoError(t, rhc.Close()) }()
+
+	entries := rhc.Snapshot()
+	require.Len(t, entries, 1)
+	assert.Equal(t, "remote.example", entries[0].Main)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&reqs))
+
+	// A re-download that gets a 304 back must report no change.
+	changed := rhc.downloadAll()
+	assert.Empty(t, changed)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&reqs))
+}
+
+func TestRemoteHostsContainer_bodyHashWithoutHeaders(t *testing.T) {
+	var body atomic.Value
+	body.Store("1.2.3.4 remote.example\n")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Deliberately send neither ETag nor Last-Modified.
+		_, _ = w.Write([]byte(body.Load().(string)))
+	}))
+	defer srv.Close()
+
+	rhc, err := NewRemoteHostsContainer(
+		0,
+		fstest.MapFS{},
+		newFakeFSWatcher(),
+		HostsExtensions{},
+		nil,
+		time.Hour,
+		[]string{srv.URL},
+	)
+	require.NoError(t, err)
+	defer func() { assert.NoError(t, rhc.Close()) }()
+
+	// Same body, no headers to go by: must be reported unchanged.
+	assert.Empty(t, rhc.downloadAll())
+
+	// Changed body, still no headers: must be reported changed.
+	body.Store("5.6.7.8 remote.example\n")
+	assert.Equal(t, []string{remoteHostsFileName(0)}, rhc.downloadAll())
+}
+
+func TestRemoteHostsContainer_backoffOn5xx(t *testing.T) {
+	var reqs int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&reqs, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	rhc, err := NewRemoteHostsContainer(
+		0,
+		fstest.MapFS{},
+		newFakeFSWatcher(),
+		HostsExtensions{},
+		nil,
+		time.Hour,
+		[]string{srv.URL},
+	)
+	require.NoError(t, err)
+	defer func() { assert.NoError(t, rhc.Close()) }()
+
+	assert.EqualValues(t, 1, atomic.LoadInt32(&reqs))
+
+	src := rhc.sources[0]
+	assert.False(t, src.nextAttempt.IsZero())
+
+	// The source is backed off, so a tick right away must not issue another
+	// request.
+	rhc.downloadAll()
+	assert.EqualValues(t, 1, atomic.LoadInt32(&reqs))
+}